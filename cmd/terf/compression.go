@@ -0,0 +1,101 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// Compression identifies the framing used on a TFRecord shard. It
+// mirrors the set of compression types tf.io.TFRecordWriter supports.
+type Compression int
+
+const (
+	// Auto asks extractFile to sniff the compression from the file's
+	// magic bytes rather than trust a caller-supplied value.
+	Auto Compression = iota - 1
+	// None is an uncompressed TFRecord stream.
+	None
+	// Zlib is a raw zlib-wrapped stream (Go's compress/zlib).
+	Zlib
+	// Gzip is a gzip-wrapped stream, the default for
+	// tf.io.TFRecordWriter(options=GZIP).
+	Gzip
+	// Snappy is the whole shard wrapped in a single Snappy-framed stream
+	// (github.com/golang/snappy), the same way Zlib and Gzip wrap the
+	// whole stream rather than framing each record individually.
+	Snappy
+)
+
+func (c Compression) String() string {
+	switch c {
+	case Auto:
+		return "auto"
+	case None:
+		return "none"
+	case Zlib:
+		return "zlib"
+	case Gzip:
+		return "gzip"
+	case Snappy:
+		return "snappy"
+	default:
+		return "unknown"
+	}
+}
+
+// ParseCompression maps a --compression flag value to a Compression.
+func ParseCompression(s string) (Compression, error) {
+	switch s {
+	case "", "auto":
+		return Auto, nil
+	case "none":
+		return None, nil
+	case "zlib":
+		return Zlib, nil
+	case "gzip":
+		return Gzip, nil
+	case "snappy":
+		return Snappy, nil
+	default:
+		return None, fmt.Errorf("terf: unknown compression %q", s)
+	}
+}
+
+// detectCompression sniffs the compression of a shard from its leading
+// magic bytes, without consuming them from r. Snappy framing has no
+// reliable magic for this purpose, so it must be requested explicitly.
+func detectCompression(r *bufio.Reader) (Compression, error) {
+	magic, err := r.Peek(2)
+	if err == io.EOF {
+		return None, nil
+	} else if err != nil {
+		return None, err
+	}
+
+	switch {
+	case magic[0] == 0x1f && magic[1] == 0x8b:
+		return Gzip, nil
+	case magic[0] == 0x78:
+		return Zlib, nil
+	default:
+		return None, nil
+	}
+}
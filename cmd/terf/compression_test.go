@@ -0,0 +1,69 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"testing"
+)
+
+func TestDetectCompression(t *testing.T) {
+	cases := []struct {
+		name string
+		data []byte
+		want Compression
+	}{
+		{"gzip magic", []byte{0x1f, 0x8b, 0x08, 0x00}, Gzip},
+		{"zlib magic", []byte{0x78, 0x9c, 0x00, 0x00}, Zlib},
+		{"raw tfrecord", []byte{0x0c, 0x00, 0x00, 0x00}, None},
+		{"empty", nil, None},
+		// Peek(2) on a single available byte returns io.EOF alongside the
+		// short read, and that EOF is checked before the magic byte, so a
+		// truncated one-byte file is reported as uncompressed rather than
+		// misread past the end of its data.
+		{"single byte", []byte{0x78}, None},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := detectCompression(bufio.NewReader(bytes.NewReader(c.data)))
+			if err != nil {
+				t.Fatalf("detectCompression: %v", err)
+			}
+			if got != c.want {
+				t.Errorf("detectCompression(%v) = %v, want %v", c.data, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDetectCompressionDoesNotConsume(t *testing.T) {
+	r := bufio.NewReader(bytes.NewReader([]byte{0x1f, 0x8b, 0x08, 0x00}))
+	if _, err := detectCompression(r); err != nil {
+		t.Fatalf("detectCompression: %v", err)
+	}
+
+	first, err := r.ReadByte()
+	if err != nil {
+		t.Fatalf("ReadByte: %v", err)
+	}
+	if first != 0x1f {
+		t.Errorf("detectCompression consumed the magic bytes it peeked; got first byte %#x", first)
+	}
+}
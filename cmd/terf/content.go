@@ -0,0 +1,63 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// hashBytes returns the SHA-256 digest and size in bytes of body.
+func hashBytes(body []byte) (string, int64) {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), int64(len(body))
+}
+
+// blobPath returns the sharded content-addressed path for a blob with
+// the given hex-encoded SHA-256 digest, e.g.
+// <outdir>/blobs/3f/3f9a....jpg.
+func blobPath(outdir, sum string) string {
+	return filepath.Join(outdir, "blobs", sum[:2], sum+".jpg")
+}
+
+// storeBlob writes body into the content-addressed blob store under
+// outdir, deduplicating by content hash. It returns the digest, size and
+// final path of the stored blob.
+func storeBlob(outdir string, body []byte) (sum string, size int64, dest string, err error) {
+	sum, size = hashBytes(body)
+	dest = blobPath(outdir, sum)
+
+	if _, statErr := os.Stat(dest); statErr == nil {
+		// An identical image has already been stored by this or an
+		// earlier shard; nothing left to do.
+		return sum, size, dest, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return "", 0, "", err
+	}
+
+	if err := os.WriteFile(dest, body, 0644); err != nil {
+		return "", 0, "", fmt.Errorf("terf: storing blob %s: %w", sum, err)
+	}
+
+	return sum, size, dest, nil
+}
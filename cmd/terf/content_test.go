@@ -0,0 +1,75 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBlobPath(t *testing.T) {
+	sum := "3f9a0000000000000000000000000000000000000000000000000000000000"
+	want := filepath.Join("/out", "blobs", "3f", sum+".jpg")
+	if got := blobPath("/out", sum); got != want {
+		t.Errorf("blobPath() = %q, want %q", got, want)
+	}
+}
+
+func TestStoreBlob(t *testing.T) {
+	outdir := t.TempDir()
+	body := []byte("not actually a jpeg, just some bytes")
+
+	sum, size, dest, err := storeBlob(outdir, body)
+	if err != nil {
+		t.Fatalf("storeBlob: %v", err)
+	}
+	if size != int64(len(body)) {
+		t.Errorf("size = %d, want %d", size, len(body))
+	}
+	if want := blobPath(outdir, sum); dest != want {
+		t.Errorf("dest = %q, want %q", dest, want)
+	}
+
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatalf("ReadFile(%s): %v", dest, err)
+	}
+	if string(got) != string(body) {
+		t.Errorf("stored blob content = %q, want %q", got, body)
+	}
+}
+
+func TestStoreBlobDedups(t *testing.T) {
+	outdir := t.TempDir()
+	body := []byte("duplicate image bytes")
+
+	sum1, _, dest1, err := storeBlob(outdir, body)
+	if err != nil {
+		t.Fatalf("storeBlob (first): %v", err)
+	}
+
+	sum2, _, dest2, err := storeBlob(outdir, body)
+	if err != nil {
+		t.Fatalf("storeBlob (second): %v", err)
+	}
+
+	if sum1 != sum2 || dest1 != dest2 {
+		t.Errorf("storing identical bytes twice produced different blobs: (%s, %s) vs (%s, %s)", sum1, dest1, sum2, dest2)
+	}
+}
@@ -18,18 +18,18 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
 	"compress/zlib"
 	"context"
-	"encoding/csv"
 	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
-	"strconv"
 
+	"github.com/golang/snappy"
 	log "github.com/sirupsen/logrus"
 	"github.com/ubccr/terf"
 	"golang.org/x/sync/errgroup"
@@ -39,7 +39,7 @@ const (
 	InfoFile = "info.csv"
 )
 
-func Extract(inputPath, outPath string, threads int, compress bool) error {
+func Extract(inputPath, outPath string, threads int, compression Compression, buildIndex bool, layout Layout, walkOpts walkOptions, format MetadataFormat, rowGroupSize int, pack PackFormat) (err error) {
 	if len(outPath) == 0 {
 		return errors.New("Please provide an output directory")
 	}
@@ -64,7 +64,7 @@ func Extract(inputPath, outPath string, threads int, compress bool) error {
 	}
 
 	if !stat.IsDir() {
-		images, err := extractFile(inputPath, outdir, compress)
+		images, err := extractFile(inputPath, outdir, compression, buildIndex, layout, pack)
 		if err != nil {
 			return err
 		}
@@ -73,65 +73,62 @@ func Extract(inputPath, outPath string, threads int, compress bool) error {
 			return errors.New("No images found")
 		}
 
-		out, err := os.Create(filepath.Join(outdir, InfoFile))
+		if pack != PackNone {
+			packs := newPackSet(pack, layout)
+			defer func() {
+				if cerr := packs.CloseAll(); cerr != nil && err == nil {
+					err = cerr
+				}
+			}()
+
+			for _, r := range images {
+				if err := packs.Add(outdir, DefaultDataset, r); err != nil {
+					return err
+				}
+			}
+		}
+
+		out, err := os.Create(filepath.Join(outdir, ManifestName(layout, format, pack)))
 		if err != nil {
 			return err
 		}
 		defer out.Close()
 
-		w := csv.NewWriter(out)
-		err = writeHeader(w)
+		mw, err := newFormattedManifestWriter(out, layout, format, rowGroupSize, pack)
 		if err != nil {
 			return err
 		}
+		if err := mw.WriteHeader(); err != nil {
+			return err
+		}
 
-		writeLabels(w, images)
-
-		w.Flush()
-		if err := w.Error(); err != nil {
+		if err := writeManifest(mw, images); err != nil {
 			return err
 		}
 
-		return nil
+		return mw.Flush()
 	}
 
 	g, ctx := errgroup.WithContext(context.TODO())
-	paths := make(chan string)
+	paths := make(chan shardPath)
 
 	g.Go(func() error {
 		defer close(paths)
-
-		files, err := ioutil.ReadDir(inputPath)
-		if err != nil {
-			return err
-		}
-
-		for _, f := range files {
-			if f.IsDir() {
-				continue
-			}
-
-			select {
-			case paths <- filepath.Join(inputPath, f.Name()):
-			case <-ctx.Done():
-				return ctx.Err()
-			}
-		}
-		return nil
+		return walkInputs(ctx, inputPath, walkOpts, paths)
 	})
 
-	images := make(chan []*ImageRecord)
+	results := make(chan shardResult)
 
 	for i := 0; i < threads; i++ {
 		g.Go(func() error {
-			for path := range paths {
-				im, err := extractFile(path, outdir, compress)
+			for sp := range paths {
+				im, err := extractFile(sp.Path, datasetDir(outdir, sp.Dataset), compression, buildIndex, layout, pack)
 				if err != nil {
 					return err
 				}
 
 				select {
-				case images <- im:
+				case results <- shardResult{Dataset: sp.Dataset, Records: im}:
 				case <-ctx.Done():
 					return ctx.Err()
 				}
@@ -143,95 +140,124 @@ func Extract(inputPath, outPath string, threads int, compress bool) error {
 
 	go func() {
 		g.Wait()
-		close(images)
+		close(results)
 	}()
 
-	out, err := os.Create(filepath.Join(outdir, InfoFile))
-	if err != nil {
-		return err
-	}
-	defer out.Close()
+	manifests := newManifestSet(layout, format, rowGroupSize, pack)
+	defer func() {
+		if cerr := manifests.CloseAll(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
 
-	w := csv.NewWriter(out)
-	err = writeHeader(w)
-	if err != nil {
-		return err
+	var packs *packSet
+	if pack != PackNone {
+		packs = newPackSet(pack, layout)
+		defer func() {
+			if cerr := packs.CloseAll(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}()
 	}
 
-	for i := range images {
-		writeLabels(w, i)
-	}
+	for res := range results {
+		if packs != nil {
+			for _, r := range res.Records {
+				if err := packs.Add(outdir, res.Dataset, r); err != nil {
+					return err
+				}
+			}
+		}
 
-	if err := g.Wait(); err != nil {
-		return err
+		mw, err := manifests.Writer(outdir, res.Dataset)
+		if err != nil {
+			return err
+		}
+
+		if err := writeManifest(mw, res.Records); err != nil {
+			return err
+		}
 	}
 
-	w.Flush()
-	if err := w.Error(); err != nil {
+	if err := g.Wait(); err != nil {
 		return err
 	}
 
-	return nil
+	return manifests.FlushAll()
 }
 
-func writeHeader(w *csv.Writer) error {
-	header := []string{
-		"image_path",
-		"id",
-		"label_id",
-		"label_text",
-		"organization",
+func extractFile(inputPath, outdir string, compression Compression, buildIndex bool, layout Layout, pack PackFormat) ([]*ImageRecord, error) {
+	in, err := os.Open(inputPath)
+	if err != nil {
+		return nil, err
 	}
+	defer in.Close()
 
-	return w.Write(header)
-}
-
-func writeLabels(w *csv.Writer, images []*ImageRecord) error {
-	for _, i := range images {
-		record := []string{
-			i.Path,
-			strconv.Itoa(i.ID),
-			strconv.Itoa(i.LabelID),
-			i.LabelText,
-			i.Organization,
-		}
+	br := bufio.NewReader(in)
 
-		if err := w.Write(record); err != nil {
-			return err
+	if compression == Auto {
+		compression, err = detectCompression(br)
+		if err != nil {
+			return nil, err
 		}
 	}
 
-	return nil
-}
-
-func extractFile(inputPath, outdir string, compress bool) ([]*ImageRecord, error) {
 	log.WithFields(log.Fields{
-		"path": inputPath,
-		"zlib": compress,
+		"path":        inputPath,
+		"compression": compression,
+		"index":       buildIndex,
 	}).Info("Processing file")
 
-	in, err := os.Open(inputPath)
-	if err != nil {
+	// A shard indexed by a previous run carries its own trailer appended
+	// after the record stream (see IndexWriter.WriteTrailer). None of our
+	// decompressors stop cleanly at the boundary of their own logical
+	// stream on every codec, so without clamping here a reread would feed
+	// the trailer's bytes back in as if they were more record data.
+	var cr *countingReader
+	if streamLen, ok, err := existingRecordStreamLength(inputPath); err != nil {
 		return nil, err
+	} else if ok {
+		cr = &countingReader{r: io.LimitReader(br, streamLen)}
+	} else {
+		cr = &countingReader{r: br}
 	}
-	defer in.Close()
 
 	var r *terf.Reader
-	if compress {
-		zin, err := zlib.NewReader(in)
+	switch compression {
+	case Gzip:
+		zin, err := gzip.NewReader(cr)
 		if err != nil {
 			return nil, err
 		}
 		defer zin.Close()
 
+		// Belt-and-braces alongside the clamp above: gzip.Reader defaults
+		// to Multistream(true), so even within the clamped length it
+		// would otherwise treat a second concatenated gzip member as more
+		// of the same stream.
+		zin.Multistream(false)
+
 		r = terf.NewReader(zin)
-	} else {
-		r = terf.NewReader(in)
+	case Zlib:
+		zin, err := zlib.NewReader(cr)
+		if err != nil {
+			return nil, err
+		}
+		defer zin.Close()
+
+		r = terf.NewReader(zin)
+	case Snappy:
+		r = terf.NewReader(snappy.NewReader(cr))
+	default:
+		r = terf.NewReader(cr)
 	}
 
 	images := make([]*ImageRecord, 0)
+	idx := NewIndexWriter()
+	shard := filepath.Base(inputPath)
 
-	for {
+	for recordIndex := 0; ; recordIndex++ {
+		offset := cr.pos
 		ex, err := r.Next()
 		if err == io.EOF {
 			break
@@ -244,27 +270,70 @@ func extractFile(inputPath, outdir string, compress bool) ([]*ImageRecord, error
 			return nil, err
 		}
 
-		if err := os.MkdirAll(filepath.Join(outdir, img.LabelText), 0755); err != nil {
-			return nil, err
+		ir := &ImageRecord{
+			ID:           img.ID,
+			LabelID:      img.LabelID,
+			LabelText:    img.LabelText,
+			Organization: img.Organization,
+			SourceShard:  shard,
+			RecordIndex:  recordIndex,
 		}
 
-		fname := filepath.Join(outdir, img.LabelText, fmt.Sprintf("%d.jpg", img.ID))
-
-		err = img.Save(fname)
+		// Encode once, in memory: none of the three output layouts below
+		// need the image to have touched disk yet, and keeping it as
+		// bytes avoids a per-image staging file (and the cross-goroutine
+		// filename collisions that come with one) entirely.
+		body, err := img.Encode()
 		if err != nil {
 			return nil, err
 		}
 
-		ir := &ImageRecord{
-			Path:         fname,
-			ID:           img.ID,
-			LabelID:      img.LabelID,
-			LabelText:    img.LabelText,
-			Organization: img.Organization,
+		switch {
+		case pack != PackNone:
+			ir.body = body
+		case layout == ContentAddressedLayout:
+			sum, size, dest, err := storeBlob(outdir, body)
+			if err != nil {
+				return nil, err
+			}
+
+			ir.SHA256 = sum
+			ir.Size = size
+			ir.Path = dest
+		default:
+			if err := os.MkdirAll(filepath.Join(outdir, img.LabelText), 0755); err != nil {
+				return nil, err
+			}
+
+			fname := filepath.Join(outdir, img.LabelText, fmt.Sprintf("%d.jpg", img.ID))
+			if err := os.WriteFile(fname, body, 0644); err != nil {
+				return nil, err
+			}
+
+			ir.Path = fname
 		}
 
 		images = append(images, ir)
+
+		if buildIndex {
+			idx.Add(IndexEntry{
+				Offset:  offset,
+				Length:  cr.pos - offset,
+				ID:      img.ID,
+				LabelID: img.LabelID,
+			})
+		}
+	}
+
+	if buildIndex {
+		if compression == None {
+			if err := idx.WriteFile(inputPath + IndexSuffix); err != nil {
+				return nil, err
+			}
+		} else if err := idx.WriteTrailer(inputPath, cr.pos); err != nil {
+			return nil, err
+		}
 	}
 
 	return images, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,391 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// IndexSuffix is appended to a shard's filename to form the path of its
+// sidecar index, e.g. "part-00000.tfrecord" -> "part-00000.tfrecord.tfidx".
+const IndexSuffix = ".tfidx"
+
+// trailerMagic marks the start of the fixed-size footer appended to a
+// compressed shard's index trailer (see WriteTrailer), borrowing the
+// eStargz TOC-footer idea: the reader seeks to the last trailerSize
+// bytes, finds this magic, and recovers where the gzip-compressed TOC
+// blob starts and how long it is.
+const trailerMagic = "TFIDXv1\x00"
+
+// trailerSize is the fixed footer length: trailerMagic, followed by an
+// 8-byte TOC offset and an 8-byte TOC length, both big-endian.
+const trailerSize = len(trailerMagic) + 8 + 8
+
+// IndexEntry records where a single example lives in a shard file, along
+// with the subset of its metadata useful for filtering without having to
+// decode the example itself.
+type IndexEntry struct {
+	Offset  int64
+	Length  int64
+	ID      int
+	LabelID int
+}
+
+// IndexWriter accumulates IndexEntry rows while a shard is being scanned
+// and flushes them to a CSV sidecar next to the shard file.
+type IndexWriter struct {
+	entries []IndexEntry
+}
+
+// NewIndexWriter returns an empty IndexWriter ready to record entries.
+func NewIndexWriter() *IndexWriter {
+	return &IndexWriter{entries: make([]IndexEntry, 0)}
+}
+
+// Add appends a single example's location to the index.
+func (iw *IndexWriter) Add(e IndexEntry) {
+	iw.entries = append(iw.entries, e)
+}
+
+// WriteFile writes the accumulated entries to path as CSV, overwriting
+// any existing file.
+func (iw *IndexWriter) WriteFile(path string) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	w := csv.NewWriter(out)
+	if err := w.Write([]string{"offset", "length", "id", "label_id"}); err != nil {
+		return err
+	}
+
+	for _, e := range iw.entries {
+		row := []string{
+			strconv.FormatInt(e.Offset, 10),
+			strconv.FormatInt(e.Length, 10),
+			strconv.Itoa(e.ID),
+			strconv.Itoa(e.LabelID),
+		}
+		if err := w.Write(row); err != nil {
+			return err
+		}
+	}
+
+	w.Flush()
+	return w.Error()
+}
+
+// WriteTrailer appends the accumulated entries to the tail of path as a
+// gzip-compressed TOC blob plus a fixed-size footer, so a compressed
+// shard stays a single self-describing file instead of needing a
+// sidecar. tocOffset is the byte offset in path where the TOC blob
+// should start, i.e. the length of the shard's own compressed record
+// stream (see countingReader). path is truncated to tocOffset first, so
+// re-running --index on an already-trailered shard replaces the old
+// trailer instead of stacking a new one after it.
+func (iw *IndexWriter) WriteTrailer(path string, tocOffset int64) error {
+	var raw bytes.Buffer
+	if err := binary.Write(&raw, binary.BigEndian, int64(len(iw.entries))); err != nil {
+		return err
+	}
+	for _, e := range iw.entries {
+		for _, v := range [4]int64{e.Offset, e.Length, int64(e.ID), int64(e.LabelID)} {
+			if err := binary.Write(&raw, binary.BigEndian, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	var toc bytes.Buffer
+	zw := gzip.NewWriter(&toc)
+	if _, err := zw.Write(raw.Bytes()); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := f.Truncate(tocOffset); err != nil {
+		return err
+	}
+
+	if _, err := f.Write(toc.Bytes()); err != nil {
+		return err
+	}
+
+	footer := make([]byte, 0, trailerSize)
+	footer = append(footer, trailerMagic...)
+	footer = appendInt64(footer, tocOffset)
+	footer = appendInt64(footer, int64(toc.Len()))
+
+	_, err = f.Write(footer)
+	return err
+}
+
+func appendInt64(b []byte, v int64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(v))
+	return append(b, buf...)
+}
+
+// readTrailerFooter reads the fixed-size footer from the tail of f, if
+// one is present, and returns the TOC blob's offset and length it
+// records. ok is false (with a nil err) when f is too small to hold a
+// footer or its magic doesn't match, which callers treat as "no
+// trailer" rather than an error.
+func readTrailerFooter(f *os.File) (tocOffset, tocLength int64, ok bool, err error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if stat.Size() < int64(trailerSize) {
+		return 0, 0, false, nil
+	}
+
+	footer := make([]byte, trailerSize)
+	if _, err := f.ReadAt(footer, stat.Size()-int64(trailerSize)); err != nil {
+		return 0, 0, false, err
+	}
+	if string(footer[:len(trailerMagic)]) != trailerMagic {
+		return 0, 0, false, nil
+	}
+
+	tocOffset = int64(binary.BigEndian.Uint64(footer[len(trailerMagic) : len(trailerMagic)+8]))
+	tocLength = int64(binary.BigEndian.Uint64(footer[len(trailerMagic)+8 : len(trailerMagic)+16]))
+	return tocOffset, tocLength, true, nil
+}
+
+// readTrailerIndex recovers the IndexEntry list from a trailer
+// previously written by IndexWriter.WriteTrailer, reading only the
+// fixed-size footer and the TOC blob it points to rather than scanning
+// path from the start.
+func readTrailerIndex(path string) ([]IndexEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tocOffset, tocLength, ok, err := readTrailerFooter(f)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("terf: %s has no index trailer", path)
+	}
+
+	gz, err := gzip.NewReader(io.NewSectionReader(f, tocOffset, tocLength))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	var count int64
+	if err := binary.Read(gz, binary.BigEndian, &count); err != nil {
+		return nil, err
+	}
+
+	entries := make([]IndexEntry, 0, count)
+	for i := int64(0); i < count; i++ {
+		var offset, length, id, labelID int64
+		for _, p := range [4]*int64{&offset, &length, &id, &labelID} {
+			if err := binary.Read(gz, binary.BigEndian, p); err != nil {
+				return nil, err
+			}
+		}
+		entries = append(entries, IndexEntry{Offset: offset, Length: length, ID: int(id), LabelID: int(labelID)})
+	}
+
+	return entries, nil
+}
+
+// existingRecordStreamLength reports the length of shardPath's own
+// compressed record stream if it already carries an index trailer, so a
+// caller about to decompress it can clamp its reader there: without the
+// clamp, a decompressor that doesn't stop cleanly at the end of its own
+// stream (gzip's concatenated-member support, Snappy's lack of any
+// framing end marker) would otherwise read straight into the appended
+// TOC blob and misinterpret it as more record data. ok is false when
+// shardPath has no trailer.
+func existingRecordStreamLength(shardPath string) (length int64, ok bool, err error) {
+	f, err := os.Open(shardPath)
+	if err != nil {
+		return 0, false, err
+	}
+	defer f.Close()
+
+	tocOffset, _, ok, err := readTrailerFooter(f)
+	if err != nil || !ok {
+		return 0, false, err
+	}
+	return tocOffset, true, nil
+}
+
+// countingReader wraps an io.Reader and tracks the total number of bytes
+// read through it, so the caller can recover the byte offset of each
+// terf.Reader.Next() call without terf exposing one itself.
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// IndexedReader provides random access to examples in a shard file using
+// a previously built index, avoiding a full sequential scan with
+// terf.Reader. For an uncompressed shard, ReadAt seeks and returns the
+// raw TFRecord bytes directly. For a compressed shard indexed via a
+// trailer (see IndexWriter.WriteTrailer), only entry metadata (ID,
+// LabelID, byte range) is available in O(1); ReadAt returns an error
+// there, since a single continuous compressed stream has no mid-stream
+// random access point the way per-chunk compression (e.g. eStargz) does.
+type IndexedReader struct {
+	f          *os.File
+	entries    []IndexEntry
+	compressed bool
+}
+
+// OpenIndexed opens shardPath for random access using its index: a
+// "<shardPath>.tfidx" sidecar if one exists (the uncompressed case), or
+// otherwise the self-describing trailer appended by --index runs on a
+// compressed shard.
+func OpenIndexed(shardPath string) (*IndexedReader, error) {
+	f, err := os.Open(shardPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if idxFile, idxErr := os.Open(shardPath + IndexSuffix); idxErr == nil {
+		defer idxFile.Close()
+
+		entries, err := readIndex(idxFile)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+
+		return &IndexedReader{f: f, entries: entries}, nil
+	}
+
+	entries, err := readTrailerIndex(shardPath)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &IndexedReader{f: f, entries: entries, compressed: true}, nil
+}
+
+func readIndex(r io.Reader) ([]IndexEntry, error) {
+	cr := csv.NewReader(r)
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("empty index")
+	}
+
+	entries := make([]IndexEntry, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		offset, err := strconv.ParseInt(row[0], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		length, err := strconv.ParseInt(row[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		id, err := strconv.Atoi(row[2])
+		if err != nil {
+			return nil, err
+		}
+		labelID, err := strconv.Atoi(row[3])
+		if err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, IndexEntry{Offset: offset, Length: length, ID: id, LabelID: labelID})
+	}
+
+	return entries, nil
+}
+
+// Len returns the number of indexed examples.
+func (ir *IndexedReader) Len() int {
+	return len(ir.entries)
+}
+
+// ReadAt returns the raw TFRecord bytes for example n in O(1). It
+// returns an error for a compressed shard, since its entries' offsets
+// are byte ranges in the compressed stream, not directly readable
+// without decompressing from the start; Find is still usable for
+// filtering by metadata without a full scan.
+func (ir *IndexedReader) ReadAt(n int) ([]byte, error) {
+	if n < 0 || n >= len(ir.entries) {
+		return nil, fmt.Errorf("index: record %d out of range", n)
+	}
+
+	if ir.compressed {
+		return nil, fmt.Errorf("index: random access to record bytes is not supported on a compressed shard; only entry metadata is available")
+	}
+
+	e := ir.entries[n]
+	buf := make([]byte, e.Length)
+	if _, err := ir.f.ReadAt(buf, e.Offset); err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// Find returns the indices of every example whose entry satisfies pred,
+// in O(n) over the (already in-memory) index rather than the file.
+func (ir *IndexedReader) Find(pred func(IndexEntry) bool) []int {
+	matches := make([]int, 0)
+	for i, e := range ir.entries {
+		if pred(e) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// Close releases the underlying shard file handle.
+func (ir *IndexedReader) Close() error {
+	return ir.f.Close()
+}
@@ -0,0 +1,93 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIndexWriterTrailerRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "part-00000.tfrecord.gz")
+	recordStream := []byte("pretend this is a compressed record stream")
+	if err := os.WriteFile(path, recordStream, 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	iw := NewIndexWriter()
+	want := []IndexEntry{
+		{Offset: 0, Length: 12, ID: 1, LabelID: 3},
+		{Offset: 12, Length: 20, ID: 2, LabelID: 3},
+	}
+	for _, e := range want {
+		iw.Add(e)
+	}
+
+	if err := iw.WriteTrailer(path, int64(len(recordStream))); err != nil {
+		t.Fatalf("WriteTrailer: %v", err)
+	}
+
+	streamLen, ok, err := existingRecordStreamLength(path)
+	if err != nil {
+		t.Fatalf("existingRecordStreamLength: %v", err)
+	}
+	if !ok {
+		t.Fatal("existingRecordStreamLength: no trailer found")
+	}
+	if streamLen != int64(len(recordStream)) {
+		t.Errorf("streamLen = %d, want %d", streamLen, len(recordStream))
+	}
+
+	ir, err := OpenIndexed(path)
+	if err != nil {
+		t.Fatalf("OpenIndexed: %v", err)
+	}
+	defer ir.Close()
+
+	if ir.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", ir.Len(), len(want))
+	}
+	for i, e := range want {
+		if ir.entries[i] != e {
+			t.Errorf("entry %d = %+v, want %+v", i, ir.entries[i], e)
+		}
+	}
+
+	if _, err := ir.ReadAt(0); err == nil {
+		t.Error("ReadAt on a compressed, trailer-backed shard should error, got nil")
+	}
+
+	matches := ir.Find(func(e IndexEntry) bool { return e.ID == 2 })
+	if len(matches) != 1 || matches[0] != 1 {
+		t.Errorf("Find(ID == 2) = %v, want [1]", matches)
+	}
+}
+
+func TestExistingRecordStreamLengthNoTrailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "part-00000.tfrecord.gz")
+	if err := os.WriteFile(path, []byte("no trailer here"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if _, ok, err := existingRecordStreamLength(path); err != nil {
+		t.Fatalf("existingRecordStreamLength: %v", err)
+	} else if ok {
+		t.Error("existingRecordStreamLength reported a trailer on a plain file")
+	}
+}
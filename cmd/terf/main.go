@@ -0,0 +1,113 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	threads := flag.Int("threads", 0, "number of worker goroutines to use when input is a directory (default: NumCPU)")
+	compressionFlag := flag.String("compression", "auto", "input compression: auto|gzip|zlib|snappy|none")
+	index := flag.Bool("index", false, "build a random-access index for each shard: a .tfidx sidecar, or a trailer appended to the shard itself when compressed")
+	layoutFlag := flag.String("layout", "path", "output layout: path|content-addressed")
+	include := flag.String("include", "", "comma-separated glob(s); only matching files are extracted")
+	exclude := flag.String("exclude", "", "comma-separated glob(s) to skip")
+	shardPattern := flag.String("shard-pattern", "", "regex grouping matched input paths into per-dataset output directories")
+	maxDepth := flag.Int("max-depth", 0, "maximum directory depth to recurse into (0: unlimited)")
+	metadataFormat := flag.String("metadata-format", "csv", "manifest format: csv|jsonl|arrow|parquet")
+	rowGroupSize := flag.Int("rowgroup-size", DefaultRowGroupSize, "rows per Arrow/Parquet row group")
+	pack := flag.String("pack", "none", "bundle extracted images into a single archive per dataset: none|tar|targz|zip")
+
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: terf [flags] <input> <outdir>")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	compression, err := ParseCompression(*compressionFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	layout, err := ParseLayout(*layoutFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	format, err := ParseMetadataFormat(*metadataFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	packFormat, err := ParsePackFormat(*pack)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var shardRe *regexp.Regexp
+	if *shardPattern != "" {
+		shardRe, err = regexp.Compile(*shardPattern)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	walkOpts := walkOptions{
+		Include:      splitCSV(*include),
+		Exclude:      splitCSV(*exclude),
+		ShardPattern: shardRe,
+		MaxDepth:     *maxDepth,
+	}
+
+	err = Extract(flag.Arg(0), flag.Arg(1), *threads, compression, *index, layout, walkOpts, format, *rowGroupSize, packFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// splitCSV splits a comma-separated flag value into its trimmed,
+// non-empty parts, returning nil for an empty string so an unset
+// --include/--exclude flag matches walkOptions' nil-means-everything
+// default.
+func splitCSV(s string) []string {
+	if s == "" {
+		return nil
+	}
+
+	parts := strings.Split(s, ",")
+	out := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
@@ -0,0 +1,285 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// Layout selects how extracted images are laid out on disk.
+type Layout int
+
+const (
+	// PathLayout writes <outdir>/<label_text>/<id>.jpg, the original
+	// behavior.
+	PathLayout Layout = iota
+	// ContentAddressedLayout writes <outdir>/blobs/<hh>/<sha256>.jpg,
+	// deduplicating identical images across shards.
+	ContentAddressedLayout
+)
+
+// ParseLayout maps a --layout flag value to a Layout.
+func ParseLayout(s string) (Layout, error) {
+	switch s {
+	case "", "path":
+		return PathLayout, nil
+	case "content-addressed":
+		return ContentAddressedLayout, nil
+	default:
+		return PathLayout, fmt.Errorf("terf: unknown layout %q", s)
+	}
+}
+
+// ManifestWriter records one row of metadata per extracted image. CSV,
+// JSONL and content-addressed manifests all implement it so Extract can
+// drive them identically.
+type ManifestWriter interface {
+	WriteHeader() error
+	WriteRecord(r *ImageRecord) error
+	Flush() error
+}
+
+// csvManifestWriter is the original info.csv schema: image_path, id,
+// label_id, label_text, organization. When pack is active, three
+// trailing columns (archive, offset, length) locate each image within
+// its archive instead of on its own on disk.
+type csvManifestWriter struct {
+	w    *csv.Writer
+	pack PackFormat
+}
+
+// NewCSVManifestWriter returns a ManifestWriter using the original
+// info.csv schema, extended with archive location columns when pack is
+// active.
+func NewCSVManifestWriter(out io.Writer, pack PackFormat) ManifestWriter {
+	return &csvManifestWriter{w: csv.NewWriter(out), pack: pack}
+}
+
+func (m *csvManifestWriter) WriteHeader() error {
+	header := []string{"image_path", "id", "label_id", "label_text", "organization"}
+	if m.pack != PackNone {
+		header = append(header, "archive", "offset", "length")
+	}
+	return m.w.Write(header)
+}
+
+func (m *csvManifestWriter) WriteRecord(r *ImageRecord) error {
+	row := []string{r.Path, strconv.Itoa(r.ID), strconv.Itoa(r.LabelID), r.LabelText, r.Organization}
+	if m.pack != PackNone {
+		row = append(row, r.ArchiveName, strconv.FormatInt(r.ArchiveOffset, 10), strconv.FormatInt(r.ArchiveLength, 10))
+	}
+	return m.w.Write(row)
+}
+
+func (m *csvManifestWriter) Flush() error {
+	m.w.Flush()
+	return m.w.Error()
+}
+
+// contentAddressedManifestWriter backs the content-addressed layout's
+// manifest.csv: sha256, size, id, label_id, label_text, organization,
+// source_shard, record_index, plus the same pack-mode archive columns
+// as csvManifestWriter when pack is active.
+type contentAddressedManifestWriter struct {
+	w    *csv.Writer
+	pack PackFormat
+}
+
+// NewContentAddressedManifestWriter returns a ManifestWriter for the
+// content-addressed layout's manifest.
+func NewContentAddressedManifestWriter(out io.Writer, pack PackFormat) ManifestWriter {
+	return &contentAddressedManifestWriter{w: csv.NewWriter(out), pack: pack}
+}
+
+func (m *contentAddressedManifestWriter) WriteHeader() error {
+	header := []string{"sha256", "size", "id", "label_id", "label_text", "organization", "source_shard", "record_index"}
+	if m.pack != PackNone {
+		header = append(header, "archive", "offset", "length")
+	}
+	return m.w.Write(header)
+}
+
+func (m *contentAddressedManifestWriter) WriteRecord(r *ImageRecord) error {
+	row := []string{
+		r.SHA256,
+		strconv.FormatInt(r.Size, 10),
+		strconv.Itoa(r.ID),
+		strconv.Itoa(r.LabelID),
+		r.LabelText,
+		r.Organization,
+		r.SourceShard,
+		strconv.Itoa(r.RecordIndex),
+	}
+	if m.pack != PackNone {
+		row = append(row, r.ArchiveName, strconv.FormatInt(r.ArchiveOffset, 10), strconv.FormatInt(r.ArchiveLength, 10))
+	}
+	return m.w.Write(row)
+}
+
+func (m *contentAddressedManifestWriter) Flush() error {
+	m.w.Flush()
+	return m.w.Error()
+}
+
+// NewManifestWriter returns the CSV ManifestWriter appropriate for
+// layout. JSONL, Arrow and Parquet manifests use the same schema
+// regardless of layout: JSONL writes every populated ImageRecord field,
+// while Arrow and Parquet have no size, source_shard or record_index
+// columns; see newFormattedManifestWriter.
+func NewManifestWriter(out io.Writer, layout Layout, pack PackFormat) ManifestWriter {
+	if layout == ContentAddressedLayout {
+		return NewContentAddressedManifestWriter(out, pack)
+	}
+	return NewCSVManifestWriter(out, pack)
+}
+
+// newFormattedManifestWriter returns the ManifestWriter for format,
+// falling back to layout's CSV schema when format is CSVMetadata. pack
+// is threaded into every format rather than overriding it, so e.g.
+// --pack=tar --metadata-format=parquet still produces a Parquet
+// manifest, just with archive/offset/length columns appended.
+func newFormattedManifestWriter(out io.Writer, layout Layout, format MetadataFormat, rowGroupSize int, pack PackFormat) (ManifestWriter, error) {
+	switch format {
+	case JSONLMetadata:
+		return NewJSONLManifestWriter(out), nil
+	case ArrowMetadata:
+		return NewArrowManifestWriter(out, rowGroupSize, pack)
+	case ParquetMetadata:
+		return NewParquetManifestWriter(out, rowGroupSize, pack)
+	default:
+		return NewManifestWriter(out, layout, pack), nil
+	}
+}
+
+// ManifestName returns the manifest filename for layout, format and
+// pack.
+func ManifestName(layout Layout, format MetadataFormat, pack PackFormat) string {
+	if pack == PackNone && format == CSVMetadata && layout == PathLayout {
+		return InfoFile
+	}
+	return "manifest." + format.extension()
+}
+
+func writeManifest(mw ManifestWriter, images []*ImageRecord) error {
+	for _, r := range images {
+		if err := mw.WriteRecord(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// shardResult carries one shard's extracted records back to the
+// collector goroutine, tagged with the dataset it belongs to.
+type shardResult struct {
+	Dataset string
+	Records []*ImageRecord
+}
+
+// datasetDir returns the directory a shard belonging to dataset should
+// extract its images into: outdir itself for the default dataset, or
+// outdir/<dataset> for a named one (see --shard-pattern).
+func datasetDir(outdir, dataset string) string {
+	if dataset == DefaultDataset {
+		return outdir
+	}
+	return filepath.Join(outdir, dataset)
+}
+
+// manifestSet lazily opens one manifest file per dataset under outdir,
+// so a --shard-pattern run produces <outdir>/<dataset>/info.csv instead
+// of a single flat manifest.
+type manifestSet struct {
+	layout       Layout
+	format       MetadataFormat
+	rowGroupSize int
+	pack         PackFormat
+	writers      map[string]ManifestWriter
+	files        map[string]*os.File
+}
+
+func newManifestSet(layout Layout, format MetadataFormat, rowGroupSize int, pack PackFormat) *manifestSet {
+	return &manifestSet{
+		layout:       layout,
+		format:       format,
+		rowGroupSize: rowGroupSize,
+		pack:         pack,
+		writers:      make(map[string]ManifestWriter),
+		files:        make(map[string]*os.File),
+	}
+}
+
+// Writer returns the ManifestWriter for dataset, creating its manifest
+// file and writing the header on first use.
+func (ms *manifestSet) Writer(outdir, dataset string) (ManifestWriter, error) {
+	if mw, ok := ms.writers[dataset]; ok {
+		return mw, nil
+	}
+
+	dir := datasetDir(outdir, dataset)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(filepath.Join(dir, ManifestName(ms.layout, ms.format, ms.pack)))
+	if err != nil {
+		return nil, err
+	}
+
+	mw, err := newFormattedManifestWriter(f, ms.layout, ms.format, ms.rowGroupSize, ms.pack)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := mw.WriteHeader(); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	ms.writers[dataset] = mw
+	ms.files[dataset] = f
+	return mw, nil
+}
+
+// FlushAll flushes every manifest opened so far.
+func (ms *manifestSet) FlushAll() error {
+	for _, mw := range ms.writers {
+		if err := mw.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CloseAll closes every manifest file opened so far, returning the first
+// error encountered. It does not flush the writers; that is FlushAll's
+// job.
+func (ms *manifestSet) CloseAll() error {
+	var first error
+	for _, f := range ms.files {
+		if err := f.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// MetadataFormat selects how a manifest is serialized to disk.
+type MetadataFormat int
+
+const (
+	// CSVMetadata is the original info.csv / manifest.csv schema.
+	CSVMetadata MetadataFormat = iota
+	// JSONLMetadata writes one JSON object per extracted image.
+	JSONLMetadata
+	// ArrowMetadata writes an Arrow IPC file with a typed, dictionary
+	// encoded schema mirroring ImageRecord.
+	ArrowMetadata
+	// ParquetMetadata writes a Parquet file, batching rows into row
+	// groups of --rowgroup-size records.
+	ParquetMetadata
+)
+
+// ParseMetadataFormat maps a --metadata-format flag value to a
+// MetadataFormat.
+func ParseMetadataFormat(s string) (MetadataFormat, error) {
+	switch s {
+	case "", "csv":
+		return CSVMetadata, nil
+	case "jsonl":
+		return JSONLMetadata, nil
+	case "arrow":
+		return ArrowMetadata, nil
+	case "parquet":
+		return ParquetMetadata, nil
+	default:
+		return CSVMetadata, fmt.Errorf("terf: unknown metadata format %q", s)
+	}
+}
+
+func (f MetadataFormat) extension() string {
+	switch f {
+	case JSONLMetadata:
+		return "jsonl"
+	case ArrowMetadata:
+		return "arrow"
+	case ParquetMetadata:
+		return "parquet"
+	default:
+		return "csv"
+	}
+}
+
+// jsonlManifestWriter writes the full ImageRecord as one JSON object per
+// line, so downstream readers get every populated field regardless of
+// layout.
+type jsonlManifestWriter struct {
+	enc *json.Encoder
+}
+
+// NewJSONLManifestWriter returns a ManifestWriter that writes JSON Lines.
+func NewJSONLManifestWriter(out io.Writer) ManifestWriter {
+	return &jsonlManifestWriter{enc: json.NewEncoder(out)}
+}
+
+func (m *jsonlManifestWriter) WriteHeader() error {
+	return nil
+}
+
+func (m *jsonlManifestWriter) WriteRecord(r *ImageRecord) error {
+	return m.enc.Encode(r)
+}
+
+func (m *jsonlManifestWriter) Flush() error {
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/hex"
+	"io"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	"github.com/apache/arrow/go/parquet"
+	"github.com/apache/arrow/go/parquet/pqarrow"
+)
+
+// DefaultRowGroupSize is used when --rowgroup-size is unset or zero.
+const DefaultRowGroupSize = 64 * 1024
+
+// imageRecordSchema mirrors ImageRecord: typed, dictionary-encoded
+// string columns for the low-cardinality fields, and an optional
+// fixed-width SHA-256 column. When pack is active, three trailing
+// columns locate each image within its archive instead of on disk.
+func imageRecordSchema(pack PackFormat) *arrow.Schema {
+	fields := []arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "label_id", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "label_text", Type: &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String}},
+		{Name: "organization", Type: &arrow.DictionaryType{IndexType: arrow.PrimitiveTypes.Int32, ValueType: arrow.BinaryTypes.String}},
+		{Name: "image_path", Type: arrow.BinaryTypes.String},
+		{Name: "sha256", Type: &arrow.FixedSizeBinaryType{ByteWidth: 32}, Nullable: true},
+	}
+
+	if pack != PackNone {
+		fields = append(fields,
+			arrow.Field{Name: "archive", Type: arrow.BinaryTypes.String},
+			arrow.Field{Name: "archive_offset", Type: arrow.PrimitiveTypes.Int64},
+			arrow.Field{Name: "archive_length", Type: arrow.PrimitiveTypes.Int64},
+		)
+	}
+
+	return arrow.NewSchema(fields, nil)
+}
+
+// batchingArrowWriter accumulates ImageRecords into an Arrow
+// RecordBuilder and flushes a batch every rowGroupSize rows, so large
+// datasets never have to sit fully in memory.
+type batchingArrowWriter struct {
+	mem         memory.Allocator
+	builder     *array.RecordBuilder
+	pack        PackFormat
+	rowGroup    int
+	rows        int
+	writeRecord func(arrow.Record) error
+	closeWriter func() error
+}
+
+func newBatchingArrowWriter(rowGroupSize int, pack PackFormat, schema *arrow.Schema, writeRecord func(arrow.Record) error, closeWriter func() error) *batchingArrowWriter {
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultRowGroupSize
+	}
+
+	mem := memory.NewGoAllocator()
+	return &batchingArrowWriter{
+		mem:         mem,
+		builder:     array.NewRecordBuilder(mem, schema),
+		pack:        pack,
+		rowGroup:    rowGroupSize,
+		writeRecord: writeRecord,
+		closeWriter: closeWriter,
+	}
+}
+
+func (w *batchingArrowWriter) WriteHeader() error {
+	return nil
+}
+
+func (w *batchingArrowWriter) WriteRecord(r *ImageRecord) error {
+	w.builder.Field(0).(*array.Int64Builder).Append(int64(r.ID))
+	w.builder.Field(1).(*array.Int32Builder).Append(int32(r.LabelID))
+	if err := w.builder.Field(2).(*array.BinaryDictionaryBuilder).AppendString(r.LabelText); err != nil {
+		return err
+	}
+	if err := w.builder.Field(3).(*array.BinaryDictionaryBuilder).AppendString(r.Organization); err != nil {
+		return err
+	}
+	w.builder.Field(4).(*array.StringBuilder).Append(r.Path)
+
+	sumBuilder := w.builder.Field(5).(*array.FixedSizeBinaryBuilder)
+	if r.SHA256 == "" {
+		sumBuilder.AppendNull()
+	} else {
+		sum, err := hex.DecodeString(r.SHA256)
+		if err != nil {
+			return err
+		}
+		sumBuilder.Append(sum)
+	}
+
+	if w.pack != PackNone {
+		w.builder.Field(6).(*array.StringBuilder).Append(r.ArchiveName)
+		w.builder.Field(7).(*array.Int64Builder).Append(r.ArchiveOffset)
+		w.builder.Field(8).(*array.Int64Builder).Append(r.ArchiveLength)
+	}
+
+	w.rows++
+	if w.rows >= w.rowGroup {
+		return w.flush()
+	}
+
+	return nil
+}
+
+func (w *batchingArrowWriter) flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+
+	rec := w.builder.NewRecord()
+	defer rec.Release()
+
+	w.rows = 0
+	return w.writeRecord(rec)
+}
+
+func (w *batchingArrowWriter) Flush() error {
+	if err := w.flush(); err != nil {
+		return err
+	}
+	return w.closeWriter()
+}
+
+// NewArrowManifestWriter returns a ManifestWriter that writes an Arrow
+// IPC file, batching rows into record batches of rowGroupSize.
+func NewArrowManifestWriter(out io.Writer, rowGroupSize int, pack PackFormat) (ManifestWriter, error) {
+	schema := imageRecordSchema(pack)
+
+	fw, err := ipc.NewFileWriter(out, ipc.WithSchema(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	return newBatchingArrowWriter(rowGroupSize, pack, schema, fw.Write, fw.Close), nil
+}
+
+// NewParquetManifestWriter returns a ManifestWriter that writes a
+// Parquet file via the Arrow/Parquet bridge, one row group per
+// rowGroupSize rows.
+func NewParquetManifestWriter(out io.Writer, rowGroupSize int, pack PackFormat) (ManifestWriter, error) {
+	schema := imageRecordSchema(pack)
+
+	if rowGroupSize <= 0 {
+		rowGroupSize = DefaultRowGroupSize
+	}
+
+	props := parquet.NewWriterProperties(parquet.WithMaxRowGroupLength(int64(rowGroupSize)))
+	arrowProps := pqarrow.DefaultWriterProps()
+
+	fw, err := pqarrow.NewFileWriter(schema, out, props, arrowProps)
+	if err != nil {
+		return nil, err
+	}
+
+	writeRecord := func(rec arrow.Record) error {
+		if err := fw.WriteBuffered(rec); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	return newBatchingArrowWriter(rowGroupSize, pack, schema, writeRecord, fw.Close), nil
+}
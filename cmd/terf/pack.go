@@ -0,0 +1,286 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// PackFormat selects whether extracted images are bundled into a single
+// archive instead of being written out as individual files.
+type PackFormat int
+
+const (
+	// PackNone writes one file per image, the original behavior.
+	PackNone PackFormat = iota
+	// PackTar bundles all images from a dataset into a single
+	// uncompressed tar, so entry offsets refer directly to the bytes on
+	// disk.
+	PackTar
+	// PackTarGz is PackTar wrapped in gzip; entry offsets still refer
+	// to the uncompressed tar stream.
+	PackTarGz
+	// PackZip bundles all images into a zip archive, stored rather than
+	// compressed so entries can still be located by byte range.
+	PackZip
+)
+
+// ParsePackFormat maps a --pack flag value to a PackFormat.
+func ParsePackFormat(s string) (PackFormat, error) {
+	switch s {
+	case "", "none":
+		return PackNone, nil
+	case "tar":
+		return PackTar, nil
+	case "targz":
+		return PackTarGz, nil
+	case "zip":
+		return PackZip, nil
+	default:
+		return PackNone, fmt.Errorf("terf: unknown pack format %q", s)
+	}
+}
+
+func (f PackFormat) filename() string {
+	switch f {
+	case PackTar:
+		return "images.tar"
+	case PackTarGz:
+		return "images.tar.gz"
+	case PackZip:
+		return "images.zip"
+	default:
+		return ""
+	}
+}
+
+// countingWriter tracks the number of bytes written through it, so a
+// packWriter can recover the byte offset of each entry it writes.
+type countingWriter struct {
+	w   io.Writer
+	pos int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.pos += int64(n)
+	return n, err
+}
+
+// packWriter serializes (name, body) entries from worker goroutines into
+// a single archive file, recording the byte offset and length of each
+// entry's body so a downstream reader can mmap the archive and seek
+// directly to an image without unpacking it.
+type packWriter struct {
+	f  *os.File
+	gz *gzip.Writer
+	tw *tar.Writer
+	zw *zip.Writer
+	cw *countingWriter
+}
+
+// newPackWriter creates path and prepares it to receive entries in the
+// given format.
+func newPackWriter(path string, format PackFormat) (*packWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pw := &packWriter{f: f}
+
+	switch format {
+	case PackZip:
+		pw.cw = &countingWriter{w: f}
+		pw.zw = zip.NewWriter(pw.cw)
+	case PackTarGz:
+		pw.gz = gzip.NewWriter(f)
+		pw.cw = &countingWriter{w: pw.gz}
+		pw.tw = tar.NewWriter(pw.cw)
+	default:
+		pw.cw = &countingWriter{w: f}
+		pw.tw = tar.NewWriter(pw.cw)
+	}
+
+	return pw, nil
+}
+
+// WriteEntry appends body to the archive under name and returns the byte
+// offset and length of body within the archive stream.
+func (pw *packWriter) WriteEntry(name string, body []byte) (offset int64, length int64, err error) {
+	if pw.zw != nil {
+		w, err := pw.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		// zip.Writer buffers its output, so flush the local header
+		// through to cw before taking the body's offset from it.
+		if err := pw.zw.Flush(); err != nil {
+			return 0, 0, err
+		}
+
+		offset = pw.cw.pos
+		if _, err := w.Write(body); err != nil {
+			return 0, 0, err
+		}
+
+		return offset, int64(len(body)), nil
+	}
+
+	hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body))}
+	if err := pw.tw.WriteHeader(hdr); err != nil {
+		return 0, 0, err
+	}
+
+	offset = pw.cw.pos
+	if _, err := pw.tw.Write(body); err != nil {
+		return 0, 0, err
+	}
+
+	return offset, int64(len(body)), nil
+}
+
+// Close flushes and closes every layer of the archive.
+func (pw *packWriter) Close() error {
+	var err error
+
+	if pw.tw != nil {
+		err = pw.tw.Close()
+	}
+	if pw.zw != nil {
+		err = pw.zw.Close()
+	}
+	if pw.gz != nil {
+		if gzErr := pw.gz.Close(); err == nil {
+			err = gzErr
+		}
+	}
+	if fErr := pw.f.Close(); err == nil {
+		err = fErr
+	}
+
+	return err
+}
+
+// packSet lazily opens one archive per dataset under outdir, mirroring
+// manifestSet.
+type packSet struct {
+	format  PackFormat
+	layout  Layout
+	writers map[string]*packWriter
+	seen    map[string]*ImageRecord
+}
+
+// newPackSet prepares a packSet that bundles entries in format. When
+// layout is ContentAddressedLayout, Add deduplicates entries by content
+// hash the same way storeBlob does for the unpacked layout, instead of
+// silently writing duplicate bodies into the archive.
+func newPackSet(format PackFormat, layout Layout) *packSet {
+	ps := &packSet{format: format, layout: layout, writers: make(map[string]*packWriter)}
+	if layout == ContentAddressedLayout {
+		ps.seen = make(map[string]*ImageRecord)
+	}
+	return ps
+}
+
+func (ps *packSet) writer(outdir, dataset string) (*packWriter, error) {
+	if pw, ok := ps.writers[dataset]; ok {
+		return pw, nil
+	}
+
+	dir := datasetDir(outdir, dataset)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	pw, err := newPackWriter(filepath.Join(dir, ps.format.filename()), ps.format)
+	if err != nil {
+		return nil, err
+	}
+
+	ps.writers[dataset] = pw
+	return pw, nil
+}
+
+// Add writes r's staged body into dataset's archive and fills in its
+// ArchiveName, ArchiveOffset and ArchiveLength fields. When ps was
+// created with ContentAddressedLayout, an r whose body duplicates one
+// already seen in the same dataset's archive is pointed at the existing
+// entry instead of being written again, mirroring storeBlob's dedup for
+// the unpacked layout.
+func (ps *packSet) Add(outdir, dataset string, r *ImageRecord) error {
+	var seenKey string
+	if ps.seen != nil {
+		sum, size := hashBytes(r.body)
+		r.SHA256 = sum
+		r.Size = size
+
+		seenKey = dataset + "/" + sum
+		if dup, ok := ps.seen[seenKey]; ok {
+			r.body = nil
+			r.Path = dup.Path
+			r.ArchiveName = dup.ArchiveName
+			r.ArchiveOffset = dup.ArchiveOffset
+			r.ArchiveLength = dup.ArchiveLength
+			return nil
+		}
+	}
+
+	pw, err := ps.writer(outdir, dataset)
+	if err != nil {
+		return err
+	}
+
+	name := filepath.Join(r.LabelText, fmt.Sprintf("%d.jpg", r.ID))
+	offset, length, err := pw.WriteEntry(name, r.body)
+	if err != nil {
+		return err
+	}
+
+	r.body = nil
+	r.Path = name
+	r.ArchiveName = ps.format.filename()
+	r.ArchiveOffset = offset
+	r.ArchiveLength = length
+
+	if ps.seen != nil {
+		ps.seen[seenKey] = r
+	}
+
+	return nil
+}
+
+// CloseAll closes every archive opened so far, returning the first
+// error encountered (e.g. a truncated write of the zip central
+// directory or final tar blocks).
+func (ps *packSet) CloseAll() error {
+	var first error
+	for _, pw := range ps.writers {
+		if err := pw.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPackSetAddDedupsContentAddressed(t *testing.T) {
+	outdir := t.TempDir()
+	ps := newPackSet(PackTar, ContentAddressedLayout)
+	defer ps.CloseAll()
+
+	first := &ImageRecord{ID: 1, LabelText: "cat", body: []byte("duplicate image bytes")}
+	if err := ps.Add(outdir, DefaultDataset, first); err != nil {
+		t.Fatalf("Add (first): %v", err)
+	}
+
+	second := &ImageRecord{ID: 2, LabelText: "dog", body: []byte("duplicate image bytes")}
+	if err := ps.Add(outdir, DefaultDataset, second); err != nil {
+		t.Fatalf("Add (second): %v", err)
+	}
+
+	if second.SHA256 != first.SHA256 {
+		t.Fatalf("SHA256 = %q, want %q", second.SHA256, first.SHA256)
+	}
+	if second.ArchiveOffset != first.ArchiveOffset || second.ArchiveLength != first.ArchiveLength {
+		t.Errorf("duplicate entry got its own archive slot: offset=%d length=%d, want offset=%d length=%d",
+			second.ArchiveOffset, second.ArchiveLength, first.ArchiveOffset, first.ArchiveLength)
+	}
+
+	unique := &ImageRecord{ID: 3, LabelText: "cat", body: []byte("a different image entirely")}
+	if err := ps.Add(outdir, DefaultDataset, unique); err != nil {
+		t.Fatalf("Add (unique): %v", err)
+	}
+	if unique.ArchiveOffset == first.ArchiveOffset {
+		t.Errorf("distinct bodies landed at the same archive offset")
+	}
+}
+
+func TestPackWriterEntryOffsets(t *testing.T) {
+	for _, format := range []PackFormat{PackTar, PackZip} {
+		format := format
+		t.Run(format.filename(), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), format.filename())
+
+			pw, err := newPackWriter(path, format)
+			if err != nil {
+				t.Fatalf("newPackWriter: %v", err)
+			}
+
+			entries := []struct {
+				name string
+				body []byte
+			}{
+				{"cat/1.jpg", []byte("first image bytes")},
+				{"dog/2.jpg", []byte("a second, differently sized image")},
+			}
+
+			offsets := make([]int64, len(entries))
+			lengths := make([]int64, len(entries))
+			for i, e := range entries {
+				offset, length, err := pw.WriteEntry(e.name, e.body)
+				if err != nil {
+					t.Fatalf("WriteEntry(%s): %v", e.name, err)
+				}
+				if length != int64(len(e.body)) {
+					t.Errorf("WriteEntry(%s) length = %d, want %d", e.name, length, len(e.body))
+				}
+				offsets[i] = offset
+				lengths[i] = length
+			}
+
+			if err := pw.Close(); err != nil {
+				t.Fatalf("Close: %v", err)
+			}
+
+			f, err := os.Open(path)
+			if err != nil {
+				t.Fatalf("Open: %v", err)
+			}
+			defer f.Close()
+
+			for i, e := range entries {
+				buf := make([]byte, lengths[i])
+				if _, err := f.ReadAt(buf, offsets[i]); err != nil {
+					t.Fatalf("ReadAt(%s): %v", e.name, err)
+				}
+				if string(buf) != string(e.body) {
+					t.Errorf("entry %s: bytes at recorded offset = %q, want %q", e.name, buf, e.body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+// ImageRecord holds the metadata written to the manifest for a single
+// extracted image. SHA256 and Size are only populated when the
+// content-addressed layout is in use. JSON field names match the
+// snake_case columns used by the CSV, content-addressed and Arrow/Parquet
+// schemas, except that the CSV schemas name the pack-mode offset and
+// length columns "offset" and "length".
+type ImageRecord struct {
+	Path         string `json:"image_path"`
+	ID           int    `json:"id"`
+	LabelID      int    `json:"label_id"`
+	LabelText    string `json:"label_text"`
+	Organization string `json:"organization"`
+
+	SHA256      string `json:"sha256,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	SourceShard string `json:"source_shard,omitempty"`
+	RecordIndex int    `json:"record_index,omitempty"`
+
+	// ArchiveName, ArchiveOffset and ArchiveLength locate this image's
+	// bytes within a packed archive; only set when --pack is used, in
+	// which case Path holds the image's entry name within the archive.
+	ArchiveName   string `json:"archive,omitempty"`
+	ArchiveOffset int64  `json:"archive_offset,omitempty"`
+	ArchiveLength int64  `json:"archive_length,omitempty"`
+
+	// body holds the decoded JPEG bytes while --pack is staging this
+	// image for its archive; cleared once packSet.Add writes it out.
+	body []byte
+}
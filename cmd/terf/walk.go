@@ -0,0 +1,150 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DefaultDataset is the dataset name used for every file when no
+// --shard-pattern is given. With a pattern, files it doesn't match are
+// skipped rather than assigned to DefaultDataset.
+const DefaultDataset = ""
+
+// shardPath is a single input file paired with the logical dataset it
+// belongs to, as determined by --shard-pattern.
+type shardPath struct {
+	Path    string
+	Dataset string
+}
+
+// walkOptions controls how walkInputs discovers and filters files under
+// a root directory.
+type walkOptions struct {
+	Include      []string
+	Exclude      []string
+	ShardPattern *regexp.Regexp
+	MaxDepth     int
+}
+
+// walkInputs walks root, sending every matching file on paths as a
+// (path, dataset) pair. It mirrors the producer-goroutine pattern used
+// elsewhere in Extract: the caller closes paths via defer once
+// walkInputs returns.
+func walkInputs(ctx context.Context, root string, opts walkOptions, paths chan<- shardPath) error {
+	var walked, matched int
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, relErr := filepath.Rel(root, path)
+		if relErr != nil {
+			return relErr
+		}
+
+		if d.IsDir() {
+			if opts.MaxDepth > 0 && rel != "." && depth(rel) >= opts.MaxDepth {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if opts.MaxDepth > 0 && depth(rel) > opts.MaxDepth {
+			return nil
+		}
+
+		if !matchesFilters(filepath.Base(path), opts.Include, opts.Exclude) {
+			return nil
+		}
+
+		walked++
+
+		dataset := DefaultDataset
+		if opts.ShardPattern != nil {
+			m := opts.ShardPattern.FindStringSubmatch(rel)
+			if m == nil {
+				return nil
+			}
+			if len(m) > 1 {
+				dataset = m[1]
+			} else {
+				dataset = m[0]
+			}
+		}
+
+		matched++
+
+		select {
+		case paths <- shardPath{Path: path, Dataset: dataset}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if opts.ShardPattern != nil {
+		log.WithFields(log.Fields{
+			"walked":  walked,
+			"matched": matched,
+			"pattern": opts.ShardPattern.String(),
+		}).Info("Filtered input files by shard pattern")
+	}
+
+	return nil
+}
+
+// depth returns the number of path separators in a root-relative path,
+// i.e. how many directories deep it is.
+func depth(rel string) int {
+	return strings.Count(filepath.ToSlash(rel), "/")
+}
+
+// matchesFilters reports whether name passes the --include/--exclude
+// glob filters. An empty include list matches everything; any exclude
+// match rejects the name outright.
+func matchesFilters(name string, include, exclude []string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return false
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+
+	for _, pattern := range include {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 terf Authors. All rights reserved.
+//
+// This file is part of terf.
+//
+// terf is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// terf is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with terf.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestMatchesFilters(t *testing.T) {
+	cases := []struct {
+		name    string
+		file    string
+		include []string
+		exclude []string
+		want    bool
+	}{
+		{"no filters matches everything", "part-00000", nil, nil, true},
+		{"include match", "part-00000.tfrecord", []string{"*.tfrecord"}, nil, true},
+		{"include miss", "part-00000.txt", []string{"*.tfrecord"}, nil, false},
+		{"exclude wins over include", "part-00000.tfrecord", []string{"*.tfrecord"}, []string{"part-00000*"}, false},
+		{"exclude only", "README.md", nil, []string{"*.md"}, false},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := matchesFilters(c.file, c.include, c.exclude); got != c.want {
+				t.Errorf("matchesFilters(%q, %v, %v) = %v, want %v", c.file, c.include, c.exclude, got, c.want)
+			}
+		})
+	}
+}
+
+func TestDepth(t *testing.T) {
+	cases := []struct {
+		rel  string
+		want int
+	}{
+		{"part-00000", 0},
+		{"train/part-00000", 1},
+		{"2024-01-01/shards/part-00000", 2},
+	}
+
+	for _, c := range cases {
+		if got := depth(c.rel); got != c.want {
+			t.Errorf("depth(%q) = %d, want %d", c.rel, got, c.want)
+		}
+	}
+}